@@ -0,0 +1,145 @@
+// Package azblob implements the backend.Backend interface over an Azure
+// Blob Storage container.
+package azblob
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/alienth/s3sync/backend"
+)
+
+func init() {
+	backend.Register("azblob", New)
+}
+
+// Backend is a prefix within an Azure Storage container.
+type Backend struct {
+	container azblob.ContainerURL
+	Prefix    string
+}
+
+// New constructs an azblob Backend for the container and prefix in u
+// (azblob://container/prefix). Credentials are read from the
+// AZURE_STORAGE_ACCOUNT / AZURE_STORAGE_ACCESS_KEY environment variables.
+func New(u *url.URL) (backend.Backend, error) {
+	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
+	key := os.Getenv("AZURE_STORAGE_ACCESS_KEY")
+	cred, err := azblob.NewSharedKeyCredential(account, key)
+	if err != nil {
+		return nil, err
+	}
+	pipeline := azblob.NewPipeline(cred, azblob.PipelineOptions{})
+	base, err := url.Parse("https://" + account + ".blob.core.windows.net/" + u.Host)
+	if err != nil {
+		return nil, err
+	}
+	return &Backend{
+		container: azblob.NewContainerURL(*base, pipeline),
+		Prefix:    strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+// key maps a relative key (as stored in location.Manifest, e.g. "/a.txt")
+// to the full blob name under this Backend's Prefix. It is the inverse of
+// relKey, so key(relKey(full)) == full for any name List returned.
+//
+// The Prefix boundary is always given a trailing "/" here, even when k is
+// empty: Azure's Prefix filtering is a literal byte-prefix match, not a
+// path boundary match, so a bare Prefix of "data" would also list sibling
+// blobs like "database/x.txt".
+func (b *Backend) key(k string) string {
+	k = strings.TrimPrefix(k, "/")
+	if b.Prefix == "" {
+		return k
+	}
+	if k == "" {
+		return b.Prefix + "/"
+	}
+	return path.Join(b.Prefix, k)
+}
+
+// relKey maps a full blob name back to the relative key List/Stat report.
+func (b *Backend) relKey(full string) string {
+	rel := full
+	if b.Prefix != "" {
+		rel = strings.TrimPrefix(full, b.Prefix+"/")
+	}
+	return "/" + rel
+}
+
+func (b *Backend) List(prefix string) ([]backend.Object, error) {
+	ctx := context.Background()
+	var objects []backend.Object
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		resp, err := b.container.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Prefix: b.key(prefix),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range resp.Segment.BlobItems {
+			objects = append(objects, backend.Object{
+				Key:          b.relKey(item.Name),
+				Size:         *item.Properties.ContentLength,
+				ETag:         string(item.Properties.Etag),
+				LastModified: item.Properties.LastModified,
+			})
+		}
+		marker = resp.NextMarker
+	}
+	return objects, nil
+}
+
+func (b *Backend) Get(key string) (io.ReadCloser, error) {
+	ctx := context.Background()
+	blob := b.container.NewBlockBlobURL(b.key(key))
+	resp, err := blob.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body(azblob.RetryReaderOptions{}), nil
+}
+
+func (b *Backend) Put(key string, r io.Reader, size int64) error {
+	ctx := context.Background()
+	blob := b.container.NewBlockBlobURL(b.key(key))
+	_, err := azblob.UploadStreamToBlockBlob(ctx, r, blob, azblob.UploadStreamToBlockBlobOptions{})
+	return err
+}
+
+func (b *Backend) Delete(key string) error {
+	ctx := context.Background()
+	blob := b.container.NewBlockBlobURL(b.key(key))
+	_, err := blob.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	if stgErr, ok := err.(azblob.StorageError); ok && stgErr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+		return nil
+	}
+	return err
+}
+
+func (b *Backend) Stat(key string) (backend.Object, error) {
+	ctx := context.Background()
+	blob := b.container.NewBlockBlobURL(b.key(key))
+	props, err := blob.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return backend.Object{}, err
+	}
+	return backend.Object{
+		Key:          key,
+		Size:         props.ContentLength(),
+		ETag:         string(props.ETag()),
+		LastModified: props.LastModified(),
+	}, nil
+}
+
+// Watch is unsupported; Azure change feed/event grid integration is out of
+// scope for syncer's polling/fsnotify model.
+func (b *Backend) Watch() (<-chan backend.Event, error) {
+	return nil, backend.ErrWatchUnsupported
+}
@@ -0,0 +1,90 @@
+// Package backend defines the storage abstraction that syncer's sync engine
+// is built on, and a registry that scheme-dispatches to the concrete driver
+// (file://, s3://, gs://, azblob://, swift://) for a given location.
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+// Object describes a single object/file as returned by List or Stat.
+type Object struct {
+	Key          string // path relative to the backend's root
+	Size         int64
+	ETag         string // content digest; format is backend-specific
+	LastModified time.Time
+	VersionID    string // object version, when the backend and bucket support versioning
+}
+
+// EventOp describes the kind of change a Watch event represents.
+type EventOp int
+
+const (
+	Create EventOp = iota
+	Write
+	Remove
+)
+
+// Event is a single change notification from Watch.
+type Event struct {
+	Key string
+	Op  EventOp
+}
+
+// ErrWatchUnsupported is returned by Watch on backends with no notion of a
+// live change feed (anything that isn't a local directory).
+var ErrWatchUnsupported = errors.New("backend: watching for changes is not supported")
+
+// Backend is the interface every storage driver implements. Keys are always
+// relative to the root the backend was constructed with (a bucket+prefix for
+// cloud backends, a directory for file://).
+type Backend interface {
+	// List returns every object under the given prefix.
+	List(prefix string) ([]Object, error)
+	// Get opens an object for reading.
+	Get(key string) (io.ReadCloser, error)
+	// Put writes size bytes read from r as key.
+	Put(key string, r io.Reader, size int64) error
+	// Delete removes an object. It is not an error to delete a missing key.
+	Delete(key string) error
+	// Stat returns metadata, including a content digest, for a single key.
+	Stat(key string) (Object, error)
+	// Watch streams change events for the backend's root. Backends that
+	// can't observe local changes return ErrWatchUnsupported.
+	Watch() (<-chan Event, error)
+}
+
+// Factory constructs a Backend from a parsed location URL.
+type Factory func(u *url.URL) (Backend, error)
+
+var registry = make(map[string]Factory)
+
+// Register associates a URL scheme with a Factory. Backend packages call
+// this from an init() func, the way rclone registers its filesystems.
+func Register(scheme string, f Factory) {
+	registry[scheme] = f
+}
+
+// New parses raw as a URL and dispatches to the Factory registered for its
+// scheme. A location with no scheme (a bare path) is treated as "file".
+func New(raw string) (Backend, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = "file"
+		u.Path = raw
+	}
+
+	f, ok := registry[scheme]
+	if !ok {
+		return nil, fmt.Errorf("backend: unsupported location scheme %q", scheme)
+	}
+	return f(u)
+}
@@ -0,0 +1,312 @@
+// Package file implements the backend.Backend interface over a local
+// directory.
+package file
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/alienth/s3sync/backend"
+	"github.com/fsnotify/fsnotify"
+)
+
+func init() {
+	backend.Register("file", New)
+}
+
+// PartSizeCandidates are the multipart part sizes (in bytes) tried, in
+// order, when reconstructing a local file's multipart ETag without being
+// told the part size used to produce the remote one.
+var PartSizeCandidates = []int64{5 * 1024 * 1024, 8 * 1024 * 1024, 16 * 1024 * 1024}
+
+// PartSize, when non-zero, overrides PartSizeCandidates and is used as the
+// only part size tried. Set from the --part-size flag.
+var PartSize int64
+
+// Recurse controls whether Watch descends into subdirectories. Set from
+// the --recursive flag.
+var Recurse bool
+
+// Backend is a directory on the local filesystem.
+type Backend struct {
+	Root string
+}
+
+// New constructs a file Backend rooted at u.Path.
+func New(u *url.URL) (backend.Backend, error) {
+	return &Backend{Root: u.Path}, nil
+}
+
+func (b *Backend) path(key string) string {
+	return filepath.Join(b.Root, key)
+}
+
+// Abs returns the absolute filesystem path for key, for use by callers
+// (such as the s3 backend's DownloadToFile fast path) that want to write
+// directly into this backend's root.
+func (b *Backend) Abs(key string) string {
+	return b.path(key)
+}
+
+// List walks the directory tree under prefix, returning every regular file
+// found. ETag is left empty; callers that need it should Stat the key,
+// since hashing every file up front would be wasteful.
+func (b *Backend) List(prefix string) ([]backend.Object, error) {
+	var objects []backend.Object
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range files {
+			full := filepath.Join(dir, fi.Name())
+			if fi.IsDir() {
+				if err := walk(full); err != nil {
+					return err
+				}
+				continue
+			}
+			key := filepath.Clean(strings.TrimPrefix(full, b.Root))
+			objects = append(objects, backend.Object{
+				Key:          key,
+				Size:         fi.Size(),
+				LastModified: fi.ModTime(),
+			})
+		}
+		return nil
+	}
+	if err := walk(filepath.Join(b.Root, prefix)); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (b *Backend) Get(key string) (io.ReadCloser, error) {
+	return os.Open(b.path(key))
+}
+
+func (b *Backend) Put(key string, r io.Reader, size int64) error {
+	dest := b.path(key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, r); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+func (b *Backend) Delete(key string) error {
+	err := os.Remove(b.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (b *Backend) Stat(key string) (backend.Object, error) {
+	path := b.path(key)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return backend.Object{}, err
+	}
+	etag, err := localETag(path, fi.Size(), "")
+	if err != nil {
+		return backend.Object{}, err
+	}
+	return backend.Object{
+		Key:          key,
+		Size:         fi.Size(),
+		ETag:         etag,
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+// MatchETag computes key's local S3-style ETag the same way Stat does, but
+// prefers a part size that actually reproduces remoteETag (the counterpart
+// object's own ETag) over guessing blind, so a file uploaded with a
+// non-default part size doesn't look permanently "changed".
+func (b *Backend) MatchETag(key, remoteETag string) (string, error) {
+	path := b.path(key)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return localETag(path, fi.Size(), remoteETag)
+}
+
+// Watch follows filesystem notifications under Root, translating them into
+// backend.Events keyed relative to Root.
+func (b *Backend) Watch() (<-chan backend.Event, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(b.Root); err != nil {
+		return nil, err
+	}
+	if Recurse {
+		files, err := ioutil.ReadDir(b.Root)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range files {
+			if fi.IsDir() {
+				watcher.Add(filepath.Join(b.Root, fi.Name()))
+			}
+		}
+	}
+
+	events := make(chan backend.Event)
+	go func() {
+		for ev := range watcher.Events {
+			fi, err := os.Lstat(ev.Name)
+			if err == nil && fi.IsDir() {
+				if Recurse && ev.Op&fsnotify.Create != 0 {
+					watcher.Add(ev.Name)
+				}
+				continue
+			}
+			key := filepath.Clean(strings.TrimPrefix(ev.Name, b.Root))
+			switch {
+			case ev.Op&fsnotify.Create != 0:
+				events <- backend.Event{Key: key, Op: backend.Create}
+			case ev.Op&fsnotify.Write != 0:
+				events <- backend.Event{Key: key, Op: backend.Write}
+			case ev.Op&fsnotify.Remove != 0:
+				events <- backend.Event{Key: key, Op: backend.Remove}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// localETag computes the digest a local file would have as an S3 ETag:
+// a plain MD5 for small/single-part objects, or the multipart scheme
+// ("<md5-of-concatenated-part-md5s>-<N>") for anything large enough to
+// plausibly have been uploaded in parts.
+//
+// remoteETag, when non-empty, is the counterpart object's own ETag; its
+// "-N" suffix tells us exactly how many parts it was uploaded in, so we
+// can pick the part size that actually reproduces it instead of just
+// trying PartSizeCandidates in order and accepting whichever didn't error
+// (multipartETag never errors on a part size that's merely wrong).
+func localETag(path string, size int64, remoteETag string) (string, error) {
+	candidates := PartSizeCandidates
+	if PartSize > 0 {
+		candidates = []int64{PartSize}
+	}
+
+	if n, ok := multipartCount(remoteETag); ok {
+		for _, ps := range candidates {
+			if size <= ps {
+				continue
+			}
+			digest, err := multipartETag(path, ps)
+			if err != nil {
+				return "", err
+			}
+			if digest == remoteETag {
+				return digest, nil
+			}
+		}
+		// None of the configured part sizes reproduced it; S3 uses a fixed
+		// part size for all but the last part, so "divide into n equal
+		// parts" only coincidentally lands on the true part boundaries.
+		// Only accept it if it actually reproduces remoteETag; otherwise
+		// fall through to the blind guesses below rather than return an
+		// unverified digest as fact.
+		partSize := size / int64(n)
+		if size%int64(n) != 0 {
+			partSize++
+		}
+		if digest, err := multipartETag(path, partSize); err == nil && digest == remoteETag {
+			return digest, nil
+		}
+	}
+
+	for _, ps := range candidates {
+		if size <= ps {
+			continue
+		}
+		if digest, err := multipartETag(path, ps); err == nil {
+			return digest, nil
+		}
+	}
+
+	return plainMD5(path)
+}
+
+// multipartCount parses the "-N" part-count suffix S3 appends to a
+// multipart object's ETag (e.g. "d41d8cd98f...-3" -> 3, ok=true). A plain,
+// single-part ETag has no such suffix and reports ok=false.
+func multipartCount(etag string) (int, bool) {
+	idx := strings.LastIndex(etag, "-")
+	if idx < 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(etag[idx+1:])
+	if err != nil || n <= 1 {
+		return 0, false
+	}
+	return n, true
+}
+
+func plainMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func multipartETag(path string, partSize int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var sums []byte
+	parts := 0
+	buf := make([]byte, partSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			h := md5.Sum(buf[:n])
+			sums = append(sums, h[:]...)
+			parts++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if parts <= 1 {
+		return plainMD5(path)
+	}
+
+	final := md5.Sum(sums)
+	return fmt.Sprintf("%x-%d", final, parts), nil
+}
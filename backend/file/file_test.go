@@ -0,0 +1,49 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestLocalETagRejectsUnverifiedPartCountGuess guards against localETag's
+// remoteETag-hinted fallback accepting a digest it never actually verified:
+// S3 uses a fixed part size for all but the last part, so dividing size by
+// the remote ETag's part count doesn't reliably reconstruct the true part
+// boundaries, and a wrong, unverified digest would cause a permanent,
+// spurious re-upload every sync.
+func TestLocalETagRejectsUnverifiedPartCountGuess(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f")
+	// 11 bytes uploaded as 5+5+1: n=3, but ceil(11/3)=4, which does not
+	// reproduce the true 5-byte part boundaries.
+	content := []byte("01234567890")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	trueETag, err := multipartETag(path, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := localETag(path, int64(len(content)), trueETag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == trueETag {
+		// Only PartSizeCandidates/PartSize are ever tried against
+		// remoteETag directly, and none divide 11 evenly into 5-byte
+		// parts, so this would mean the unverified ceil(size/n) guess
+		// happened to be accepted without being checked.
+		t.Fatalf("localETag returned the true multipart digest %q via an unverified guess", got)
+	}
+
+	want, err := plainMD5(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("localETag(%q) = %q, want the plain-MD5 fallback %q", path, got, want)
+	}
+}
@@ -0,0 +1,132 @@
+// Package gcs implements the backend.Backend interface over a Google Cloud
+// Storage bucket.
+package gcs
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/alienth/s3sync/backend"
+	"google.golang.org/api/iterator"
+)
+
+func init() {
+	backend.Register("gs", New)
+}
+
+// Backend is a prefix within a GCS bucket.
+type Backend struct {
+	client *storage.Client
+	bucket *storage.BucketHandle
+	Prefix string
+}
+
+// New constructs a GCS Backend for the bucket and prefix in u
+// (gs://bucket/prefix).
+func New(u *url.URL) (backend.Backend, error) {
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &Backend{
+		client: client,
+		bucket: client.Bucket(u.Host),
+		Prefix: strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+// key maps a relative key (as stored in location.Manifest, e.g. "/a.txt")
+// to the full object name under this Backend's Prefix. It is the inverse
+// of relKey, so key(relKey(full)) == full for any name List returned.
+//
+// The Prefix boundary is always given a trailing "/" here, even when k is
+// empty: GCS's Prefix filtering is a literal byte-prefix match, not a path
+// boundary match, so a bare Prefix of "data" would also list sibling
+// objects like "database/x.txt".
+func (b *Backend) key(k string) string {
+	k = strings.TrimPrefix(k, "/")
+	if b.Prefix == "" {
+		return k
+	}
+	if k == "" {
+		return b.Prefix + "/"
+	}
+	return path.Join(b.Prefix, k)
+}
+
+// relKey maps a full object name back to the relative key List/Stat report.
+func (b *Backend) relKey(full string) string {
+	rel := full
+	if b.Prefix != "" {
+		rel = strings.TrimPrefix(full, b.Prefix+"/")
+	}
+	return "/" + rel
+}
+
+func (b *Backend) List(prefix string) ([]backend.Object, error) {
+	ctx := context.Background()
+	it := b.bucket.Objects(ctx, &storage.Query{Prefix: b.key(prefix)})
+
+	var objects []backend.Object
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, backend.Object{
+			Key:          b.relKey(attrs.Name),
+			Size:         attrs.Size,
+			ETag:         attrs.Etag,
+			LastModified: attrs.Updated,
+		})
+	}
+	return objects, nil
+}
+
+func (b *Backend) Get(key string) (io.ReadCloser, error) {
+	return b.bucket.Object(b.key(key)).NewReader(context.Background())
+}
+
+func (b *Backend) Put(key string, r io.Reader, size int64) error {
+	ctx := context.Background()
+	w := b.bucket.Object(b.key(key)).NewWriter(ctx)
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (b *Backend) Delete(key string) error {
+	err := b.bucket.Object(b.key(key)).Delete(context.Background())
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	return err
+}
+
+func (b *Backend) Stat(key string) (backend.Object, error) {
+	attrs, err := b.bucket.Object(b.key(key)).Attrs(context.Background())
+	if err != nil {
+		return backend.Object{}, err
+	}
+	return backend.Object{
+		Key:          key,
+		Size:         attrs.Size,
+		ETag:         attrs.Etag,
+		LastModified: attrs.Updated,
+	}, nil
+}
+
+// Watch is unsupported; GCS changes are observed via Pub/Sub notifications,
+// which is out of scope for syncer's polling/fsnotify model.
+func (b *Backend) Watch() (<-chan backend.Event, error) {
+	return nil, backend.ErrWatchUnsupported
+}
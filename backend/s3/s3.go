@@ -0,0 +1,216 @@
+// Package s3 implements the backend.Backend interface over an S3 bucket.
+package s3
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alienth/s3sync/backend"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func init() {
+	backend.Register("s3", New)
+}
+
+// PartSize is the part size, in bytes, used by both the uploader and
+// downloader for multipart transfers. Set from the --part-size flag.
+var PartSize int64 = s3manager.DefaultUploadPartSize
+
+// Concurrency is the number of parts transferred at once by a single
+// object's Upload/Download. Set from the --concurrency flag.
+var Concurrency = s3manager.DefaultUploadConcurrency
+
+// RaceWindow is how recently an object can have been modified before List
+// stops trusting the listing alone and re-verifies it with a HeadObject.
+// S3 listings are only eventually consistent with recent writes, so a
+// just-written object can appear in a listing with stale metadata, or be
+// absent from one entirely; borrowed from Arvados keepstore's s3RaceWindow.
+// Set from the --s3-race-window flag.
+var RaceWindow = 75 * time.Second
+
+// Backend is a prefix within an S3 bucket.
+type Backend struct {
+	svc    *s3.S3
+	Bucket string
+	Prefix string
+}
+
+// New constructs an S3 Backend for the bucket and prefix in u
+// (s3://bucket/prefix).
+func New(u *url.URL) (backend.Backend, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return nil, err
+	}
+	return &Backend{
+		svc:    s3.New(sess),
+		Bucket: u.Host,
+		Prefix: strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+// key maps a relative key (as stored in location.Manifest, e.g. "/a.txt")
+// to the full S3 key under this Backend's Prefix. It is the inverse of
+// relKey, so key(relKey(full)) == full for any key List actually returned.
+//
+// The Prefix boundary is always given a trailing "/" here, even when k is
+// empty: S3's Prefix filtering is a literal byte-prefix match, not a path
+// boundary match, so a bare Prefix of "data" would also list sibling keys
+// like "database/x.txt".
+func (b *Backend) key(k string) string {
+	k = strings.TrimPrefix(k, "/")
+	if b.Prefix == "" {
+		return k
+	}
+	if k == "" {
+		return b.Prefix + "/"
+	}
+	return path.Join(b.Prefix, k)
+}
+
+// relKey maps a full S3 key back to the relative key List/Stat report.
+func (b *Backend) relKey(full string) string {
+	rel := full
+	if b.Prefix != "" {
+		rel = strings.TrimPrefix(full, b.Prefix+"/")
+	}
+	return "/" + rel
+}
+
+func (b *Backend) List(prefix string) ([]backend.Object, error) {
+	var objects []backend.Object
+	input := s3.ListObjectsV2Input{
+		Bucket: aws.String(b.Bucket),
+		Prefix: aws.String(b.key(prefix)),
+	}
+	err := b.svc.ListObjectsV2Pages(&input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			object := backend.Object{
+				Key:          b.relKey(*o.Key),
+				Size:         *o.Size,
+				ETag:         strings.Trim(*o.ETag, `"`),
+				LastModified: *o.LastModified,
+			}
+			if RaceWindow > 0 && time.Since(object.LastModified) < RaceWindow {
+				head, err := b.svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(b.Bucket), Key: o.Key})
+				if err != nil {
+					// The listing raced ahead of a delete or an
+					// overwrite-in-progress; skip it until it settles.
+					continue
+				}
+				object.Size = *head.ContentLength
+				object.ETag = strings.Trim(*head.ETag, `"`)
+				object.LastModified = *head.LastModified
+				object.VersionID = aws.StringValue(head.VersionId)
+			}
+			objects = append(objects, object)
+		}
+		return true
+	})
+	return objects, err
+}
+
+func (b *Backend) Get(key string) (io.ReadCloser, error) {
+	out, err := b.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(b.key(key)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// Put streams r to key as a concurrent multipart upload via s3manager,
+// rather than buffering the whole object before a single PutObject call.
+func (b *Backend) Put(key string, r io.Reader, size int64) error {
+	uploader := s3manager.NewUploaderWithClient(b.svc, func(u *s3manager.Uploader) {
+		u.PartSize = PartSize
+		u.Concurrency = Concurrency
+	})
+	_, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(b.key(key)),
+		Body:   r,
+	})
+	return err
+}
+
+// DownloadToFile fetches key with ranged, concurrent GETs via
+// s3manager.Downloader and writes it directly to path, avoiding the extra
+// buffering a generic Get-then-Put copy would require.
+func (b *Backend) DownloadToFile(key, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	downloader := s3manager.NewDownloaderWithClient(b.svc, func(d *s3manager.Downloader) {
+		d.PartSize = PartSize
+		d.Concurrency = Concurrency
+	})
+	_, err = downloader.Download(out, &s3.GetObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(b.key(key)),
+	})
+	return err
+}
+
+func (b *Backend) Delete(key string) error {
+	_, err := b.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(b.key(key)),
+	})
+	return err
+}
+
+func (b *Backend) Stat(key string) (backend.Object, error) {
+	out, err := b.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(b.key(key)),
+	})
+	if err != nil {
+		return backend.Object{}, err
+	}
+	return backend.Object{
+		Key:          key,
+		Size:         *out.ContentLength,
+		ETag:         strings.Trim(*out.ETag, `"`),
+		LastModified: *out.LastModified,
+		VersionID:    aws.StringValue(out.VersionId),
+	}, nil
+}
+
+// GetVersion opens a specific version of key for reading, for use by
+// `syncer manifests restore` when replaying a manifest recorded against a
+// versioned bucket.
+func (b *Backend) GetVersion(key, versionID string) (io.ReadCloser, error) {
+	out, err := b.svc.GetObject(&s3.GetObjectInput{
+		Bucket:    aws.String(b.Bucket),
+		Key:       aws.String(b.key(key)),
+		VersionId: aws.String(versionID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// Watch is unsupported; S3 has no push notification of changes that syncer
+// can subscribe to without additional infrastructure (SQS/SNS).
+func (b *Backend) Watch() (<-chan backend.Event, error) {
+	return nil, backend.ErrWatchUnsupported
+}
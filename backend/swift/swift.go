@@ -0,0 +1,129 @@
+// Package swift implements the backend.Backend interface over an OpenStack
+// Swift container.
+package swift
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/alienth/s3sync/backend"
+	"github.com/ncw/swift"
+)
+
+func init() {
+	backend.Register("swift", New)
+}
+
+// Backend is a prefix within a Swift container.
+type Backend struct {
+	conn      *swift.Connection
+	Container string
+	Prefix    string
+}
+
+// New constructs a Swift Backend for the container and prefix in u
+// (swift://container/prefix). Credentials are read from the standard
+// OS_USERNAME / OS_PASSWORD / OS_AUTH_URL / OS_TENANT_NAME environment
+// variables.
+func New(u *url.URL) (backend.Backend, error) {
+	conn := &swift.Connection{
+		UserName: os.Getenv("OS_USERNAME"),
+		ApiKey:   os.Getenv("OS_PASSWORD"),
+		AuthUrl:  os.Getenv("OS_AUTH_URL"),
+		Tenant:   os.Getenv("OS_TENANT_NAME"),
+	}
+	if err := conn.Authenticate(); err != nil {
+		return nil, err
+	}
+	return &Backend{
+		conn:      conn,
+		Container: u.Host,
+		Prefix:    strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+// key maps a relative key (as stored in location.Manifest, e.g. "/a.txt")
+// to the full object name under this Backend's Prefix. It is the inverse
+// of relKey, so key(relKey(full)) == full for any name List returned.
+//
+// The Prefix boundary is always given a trailing "/" here, even when k is
+// empty: Swift's Prefix filtering is a literal byte-prefix match, not a
+// path boundary match, so a bare Prefix of "data" would also list sibling
+// objects like "database/x.txt".
+func (b *Backend) key(k string) string {
+	k = strings.TrimPrefix(k, "/")
+	if b.Prefix == "" {
+		return k
+	}
+	if k == "" {
+		return b.Prefix + "/"
+	}
+	return path.Join(b.Prefix, k)
+}
+
+// relKey maps a full object name back to the relative key List/Stat report.
+func (b *Backend) relKey(full string) string {
+	rel := full
+	if b.Prefix != "" {
+		rel = strings.TrimPrefix(full, b.Prefix+"/")
+	}
+	return "/" + rel
+}
+
+func (b *Backend) List(prefix string) ([]backend.Object, error) {
+	opts := &swift.ObjectsOpts{Prefix: b.key(prefix)}
+	infos, err := b.conn.ObjectsAll(b.Container, opts)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]backend.Object, 0, len(infos))
+	for _, o := range infos {
+		objects = append(objects, backend.Object{
+			Key:          b.relKey(o.Name),
+			Size:         o.Bytes,
+			ETag:         o.Hash,
+			LastModified: o.LastModified,
+		})
+	}
+	return objects, nil
+}
+
+func (b *Backend) Get(key string) (io.ReadCloser, error) {
+	f, _, err := b.conn.ObjectOpen(b.Container, b.key(key), true, nil)
+	return f, err
+}
+
+func (b *Backend) Put(key string, r io.Reader, size int64) error {
+	_, err := b.conn.ObjectPut(b.Container, b.key(key), r, false, "", "", nil)
+	return err
+}
+
+func (b *Backend) Delete(key string) error {
+	err := b.conn.ObjectDelete(b.Container, b.key(key))
+	if err == swift.ObjectNotFound {
+		return nil
+	}
+	return err
+}
+
+func (b *Backend) Stat(key string) (backend.Object, error) {
+	info, _, err := b.conn.Object(b.Container, b.key(key))
+	if err != nil {
+		return backend.Object{}, err
+	}
+	return backend.Object{
+		Key:          key,
+		Size:         info.Bytes,
+		ETag:         info.Hash,
+		LastModified: info.LastModified,
+	}, nil
+}
+
+// Watch is unsupported; Swift has no push notification of container
+// changes that syncer can subscribe to.
+func (b *Backend) Watch() (<-chan backend.Event, error) {
+	return nil, backend.ErrWatchUnsupported
+}
@@ -0,0 +1,36 @@
+package swift
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyRelKeyRoundTrip(t *testing.T) {
+	cases := []struct {
+		prefix string
+		full   string
+	}{
+		{prefix: "", full: "a.txt"},
+		{prefix: "", full: "dir/a.txt"},
+		{prefix: "data", full: "data/a.txt"},
+		{prefix: "data", full: "data/dir/a.txt"},
+	}
+
+	for _, c := range cases {
+		b := &Backend{Prefix: c.prefix}
+		rel := b.relKey(c.full)
+		if got := b.key(rel); got != c.full {
+			t.Errorf("prefix %q: key(relKey(%q)) = %q, want %q", c.prefix, c.full, got, c.full)
+		}
+	}
+}
+
+// TestKeyListBoundaryHasTrailingSlash guards against key("") being used as
+// a Swift List Prefix that also matches sibling objects sharing the same
+// string prefix (e.g. Prefix "data" matching "database/x.txt").
+func TestKeyListBoundaryHasTrailingSlash(t *testing.T) {
+	b := &Backend{Prefix: "data"}
+	if got := b.key(""); !strings.HasSuffix(got, "/") {
+		t.Errorf("key(\"\") = %q, want a trailing slash so it doesn't absorb sibling prefixes", got)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// filterRule is one --include/--exclude/--filter-from line. Rules are
+// evaluated in order and the last one to match a key wins, the way rclone
+// resolves its filter rules.
+type filterRule struct {
+	include bool
+	re      *regexp.Regexp
+	// anchored patterns (those starting with "/") only match from the
+	// start of the key; unanchored patterns may match starting at any
+	// path segment boundary.
+	anchored bool
+}
+
+// Filter decides, for a given key and size, whether a sync should touch it.
+type Filter struct {
+	rules   []filterRule
+	minSize int64
+	maxSize int64
+}
+
+// newFilter builds a Filter from a sync command's --include, --exclude,
+// --filter-from, --max-size and --min-size flags.
+func newFilter(c *cli.Context) (*Filter, error) {
+	f := &Filter{
+		minSize: c.Int64("min-size"),
+		maxSize: c.Int64("max-size"),
+	}
+
+	if path := c.String("filter-from"); path != "" {
+		lines, err := readFilterFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			include := true
+			switch {
+			case strings.HasPrefix(line, "+"):
+				line = strings.TrimSpace(strings.TrimPrefix(line, "+"))
+			case strings.HasPrefix(line, "-"):
+				include = false
+				line = strings.TrimSpace(strings.TrimPrefix(line, "-"))
+			}
+			if err := f.addRule(include, line); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, pattern := range c.StringSlice("exclude") {
+		if err := f.addRule(false, pattern); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range c.StringSlice("include") {
+		if err := f.addRule(true, pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+func readFilterFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+func (f *Filter) addRule(include bool, pattern string) error {
+	// A leading "!", gitignore-style, always negates to an include rule,
+	// regardless of which flag or filter-from prefix it arrived through
+	// (e.g. --exclude '!keep/**' carves an exception out of a broader
+	// exclude).
+	if strings.HasPrefix(pattern, "!") {
+		include = true
+		pattern = strings.TrimSpace(strings.TrimPrefix(pattern, "!"))
+	}
+	anchored := strings.HasPrefix(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	re, err := globToRegexp(pattern)
+	if err != nil {
+		return fmt.Errorf("bad filter pattern %q: %s", pattern, err)
+	}
+	f.rules = append(f.rules, filterRule{include: include, re: re, anchored: anchored})
+	return nil
+}
+
+// Allowed reports whether key, with the given size, should be synced.
+func (f *Filter) Allowed(key string, size int64) bool {
+	if f == nil {
+		return true
+	}
+	if f.minSize > 0 && size < f.minSize {
+		return false
+	}
+	if f.maxSize > 0 && size > f.maxSize {
+		return false
+	}
+	return f.PathAllowed(key)
+}
+
+// PathAllowed reports whether key matches the include/exclude glob rules,
+// ignoring the size predicates (useful for delete events, where the size
+// of the now-gone file isn't available).
+func (f *Filter) PathAllowed(key string) bool {
+	if f == nil {
+		return true
+	}
+	allowed := true
+	key = strings.TrimPrefix(key, "/")
+	for _, r := range f.rules {
+		if matchRule(r, key) {
+			allowed = r.include
+		}
+	}
+	return allowed
+}
+
+func matchRule(r filterRule, key string) bool {
+	if r.re.MatchString(key) {
+		return true
+	}
+	if r.anchored {
+		return false
+	}
+	// Unanchored patterns may also match starting at any path segment.
+	for i := 0; i < len(key); i++ {
+		if key[i] == '/' && r.re.MatchString(key[i+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// globToRegexp translates a gitignore-style glob ("**/*.log", "keep/**")
+// into an anchored regexp: "**" matches any number of path segments, "*"
+// matches within a single segment, and "?" matches one character.
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '*':
+			if i+1 < len(runes) && runes[i+1] == '*' {
+				if i+2 < len(runes) && runes[i+2] == '/' {
+					// "**/" matches any number of path segments,
+					// including zero, so "**/*.log" also matches a
+					// top-level "app.log".
+					b.WriteString("(?:.*/)?")
+					i += 2
+				} else {
+					b.WriteString(".*")
+					i++
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// filterFlags are shared between the sync command's --include/--exclude
+// family and any future command that needs the same selection rules.
+var filterFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "include",
+		Usage: "Gitignore-style glob to include, repeatable. Evaluated in the order given, after every --exclude rule; last match wins.",
+	},
+	cli.StringSliceFlag{
+		Name:  "exclude",
+		Usage: "Gitignore-style glob to exclude, repeatable. Evaluated in the order given, before every --include rule; last match wins.",
+	},
+	cli.StringFlag{
+		Name:  "filter-from",
+		Usage: "Path to a file of +/-prefixed filter rules, one per line, applied before --include/--exclude.",
+	},
+	cli.Int64Flag{
+		Name:  "max-size",
+		Usage: "Skip files larger than this many bytes.",
+	},
+	cli.Int64Flag{
+		Name:  "min-size",
+		Usage: "Skip files smaller than this many bytes.",
+	},
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGlobToRegexpDoubleStarSlash(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"**/*.log", "app.log", true},
+		{"**/*.log", "a/b/app.log", true},
+		{"**/*.log", "app.txt", false},
+		{"keep/**", "keep/a.txt", true},
+		{"keep/**", "keep/a/b.txt", true},
+	}
+	for _, c := range cases {
+		re, err := globToRegexp(c.pattern)
+		if err != nil {
+			t.Fatalf("globToRegexp(%q): %s", c.pattern, err)
+		}
+		if got := re.MatchString(c.key); got != c.want {
+			t.Errorf("globToRegexp(%q).MatchString(%q) = %v, want %v", c.pattern, c.key, got, c.want)
+		}
+	}
+}
+
+func TestFilterNegation(t *testing.T) {
+	f := &Filter{}
+	if err := f.addRule(false, "keep/**"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.addRule(false, "!keep/special.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.PathAllowed("keep/a.txt") {
+		t.Error("keep/a.txt: want excluded by keep/**")
+	}
+	if !f.PathAllowed("keep/special.txt") {
+		t.Error("keep/special.txt: want re-included by !keep/special.txt")
+	}
+}
+
+func TestReadFilterFileNegation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules")
+	contents := "-keep/**\n!keep/special.txt\n"
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := readFilterFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &Filter{}
+	for _, line := range lines {
+		include := true
+		switch {
+		case line[0] == '+':
+			line = line[1:]
+		case line[0] == '-':
+			include = false
+			line = line[1:]
+		}
+		if err := f.addRule(include, line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if f.PathAllowed("keep/a.txt") {
+		t.Error("keep/a.txt: want excluded by -keep/**")
+	}
+	if !f.PathAllowed("keep/special.txt") {
+		t.Error("keep/special.txt: want re-included by !keep/special.txt")
+	}
+}
+
+func TestFilterLastMatchWins(t *testing.T) {
+	f := &Filter{}
+	if err := f.addRule(false, "*.log"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.addRule(true, "important.log"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.PathAllowed("important.log") {
+		t.Error("important.log: want included by the later, more specific rule")
+	}
+	if f.PathAllowed("debug.log") {
+		t.Error("debug.log: want excluded by *.log")
+	}
+}
+
+func TestFilterAllowedSizePredicates(t *testing.T) {
+	f := &Filter{minSize: 10, maxSize: 100}
+
+	if f.Allowed("a.txt", 5) {
+		t.Error("size 5: want excluded, below minSize")
+	}
+	if f.Allowed("a.txt", 200) {
+		t.Error("size 200: want excluded, above maxSize")
+	}
+	if !f.Allowed("a.txt", 50) {
+		t.Error("size 50: want allowed")
+	}
+}
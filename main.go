@@ -1,21 +1,19 @@
 package main
 
 import (
-	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/alienth/fastlyctl/util"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/fsnotify/fsnotify"
+	"github.com/alienth/s3sync/backend"
+	_ "github.com/alienth/s3sync/backend/azblob"
+	backendfile "github.com/alienth/s3sync/backend/file"
+	_ "github.com/alienth/s3sync/backend/gcs"
+	backends3 "github.com/alienth/s3sync/backend/s3"
+	_ "github.com/alienth/s3sync/backend/swift"
 	"github.com/urfave/cli"
 )
 
@@ -34,6 +32,44 @@ import (
 
 var noop = false
 var recurse = false
+var fastCompare = false
+var partSizeFlag int64
+var maxParallelFiles = 4
+var activeFilter *Filter
+var raceWindow time.Duration
+
+func syncBefore(c *cli.Context) error {
+	if !util.IsInteractive() && !c.GlobalBool("assume-yes") {
+		return cli.NewExitError(util.ErrNonInteractive.Error(), -1)
+	}
+	if c.Bool("noop") {
+		log.Println("!!! Running in no-op mode.")
+		noop = true
+	}
+	if c.Bool("recursive") {
+		recurse = true
+	}
+	if c.Bool("fast") {
+		fastCompare = true
+	}
+	partSizeFlag = c.Int64("part-size")
+	backendfile.Recurse = recurse
+	backendfile.PartSize = partSizeFlag
+	if partSizeFlag > 0 {
+		backends3.PartSize = partSizeFlag
+	}
+	backends3.Concurrency = c.Int("concurrency")
+	maxParallelFiles = c.Int("max-parallel-files")
+	raceWindow = c.Duration("s3-race-window")
+	backends3.RaceWindow = raceWindow
+
+	f, err := newFilter(c)
+	if err != nil {
+		return err
+	}
+	activeFilter = f
+	return nil
+}
 
 func main() {
 	app := cli.NewApp()
@@ -52,7 +88,7 @@ func main() {
 			Aliases:   []string{"p"},
 			Usage:     "Continuously copy all objects from source to the destination.",
 			ArgsUsage: "<SOURCE> <DESTINATION>...",
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.BoolFlag{
 					Name:  "noop, n",
 					Usage: "Push new config versions, but do not activate.",
@@ -69,21 +105,81 @@ func main() {
 					Name:  "one-time",
 					Usage: "Only sync one-time rather than continuously.",
 				},
+				cli.BoolFlag{
+					Name:  "fast",
+					Usage: "Compare files by size and mtime instead of content digest.",
+				},
+				cli.Int64Flag{
+					Name:  "part-size",
+					Usage: "Part size, in bytes, used when reconstructing a local file's multipart ETag, and for S3 multipart transfers. Defaults to trying 5/8/16 MB for ETags, 5 MB for transfers.",
+				},
+				cli.IntFlag{
+					Name:  "concurrency",
+					Value: 5,
+					Usage: "Number of parts transferred concurrently per S3 object.",
+				},
+				cli.IntFlag{
+					Name:  "max-parallel-files",
+					Value: 4,
+					Usage: "Number of files transferred concurrently during a sync.",
+				},
+				cli.DurationFlag{
+					Name:  "manifest-interval",
+					Usage: "Store a manifest snapshot of the destination once this long has passed since the last one, checked as each watch event arrives. Disabled by default.",
+				},
+				cli.IntFlag{
+					Name:  "manifest-every",
+					Usage: "Store a manifest snapshot of the destination after this many events. Disabled by default.",
+				},
+				cli.StringFlag{
+					Name:  "sign-key",
+					Usage: "Path to a raw ed25519 private key seed used to sign manifests.",
+				},
+				cli.DurationFlag{
+					Name:  "s3-race-window",
+					Value: 75 * time.Second,
+					Usage: "Objects modified more recently than this are re-verified with a HeadObject instead of trusted from the listing, and recently-written local files missing from the destination listing aren't re-pushed. Guards against S3's eventually-consistent listings. Set to 0 to disable.",
+				},
+			}, filterFlags...),
+			Before: syncBefore,
+			Action: runSync,
+		},
+		cli.Command{
+			Name:      "serve",
+			Usage:     "Serve a local directory as an S3-compatible endpoint.",
+			ArgsUsage: "<PATH>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: ":8080",
+					Usage: "Address to listen on.",
+				},
 			},
-			Before: func(c *cli.Context) error {
-				if !util.IsInteractive() && !c.GlobalBool("assume-yes") {
-					return cli.NewExitError(util.ErrNonInteractive.Error(), -1)
-				}
-				if c.Bool("noop") {
-					log.Println("!!! Running in no-op mode.")
-					noop = true
-				}
-				if c.Bool("recurse") {
-					recurse = true
-				}
-				return nil
+			Action: serveCommand,
+		},
+		cli.Command{
+			Name:  "manifests",
+			Usage: "Inspect and restore versioned manifest snapshots.",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:      "list",
+					Usage:     "List manifest snapshots stored at a location.",
+					ArgsUsage: "<LOCATION>",
+					Action:    manifestsListCommand,
+				},
+				cli.Command{
+					Name:      "restore",
+					Usage:     "Restore a target directory to a given manifest.",
+					ArgsUsage: "<LOCATION> <MANIFEST-ID> <TARGET>",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "trusted-key",
+							Usage: "Path to a raw ed25519 public key the manifest's embedded key must match.",
+						},
+					},
+					Action: manifestsRestoreCommand,
+				},
 			},
-			Action: sync,
 		},
 	}
 
@@ -94,7 +190,9 @@ func main() {
 
 }
 
-func sync(c *cli.Context) error {
+// runSync implements the "sync" command. It's not named sync to avoid
+// colliding with the imported sync package.
+func runSync(c *cli.Context) error {
 	source, destination, err := getLocations(c)
 	if err != nil {
 		return err
@@ -111,39 +209,46 @@ func sync(c *cli.Context) error {
 
 	oneTimeSync(c, source, destination)
 
-	source.Watch()
-	return nil
-}
+	if err := storeManifest(c, destination); err != nil {
+		log.Println("error storing manifest:", err)
+	}
 
-func (l *location) Watch() {
-	watcher, _ := fsnotify.NewWatcher()
-	watcher.Add(l.Path)
-	if recurse {
-		files, err := ioutil.ReadDir(l.Path)
-		if err != nil {
-			log.Fatal(err)
+	if !c.Bool("one-time") {
+		onEvent := manifestTrigger(c, destination)
+		if err := source.Watch(onEvent); err != nil && err != backend.ErrWatchUnsupported {
+			return err
+		} else if err == backend.ErrWatchUnsupported {
+			log.Println("source does not support continuous watching; exiting after one-time sync.")
 		}
+	}
+	return nil
+}
 
-		for _, f := range files {
-			if f.IsDir() {
-				watcher.Add(l.Path + "/" + f.Name())
-			}
-		}
+// manifestTrigger returns a callback to pass to location.Watch that stores a
+// fresh manifest of destination every --manifest-every events and/or once
+// --manifest-interval has passed since the last one, whichever is
+// configured. Both are checked only as events arrive: while no events
+// come in, no manifest is stored, however long the interval has passed.
+func manifestTrigger(c *cli.Context, destination *location) func() {
+	interval := c.Duration("manifest-interval")
+	everyEvents := c.Int("manifest-every")
+	if interval <= 0 && everyEvents <= 0 {
+		return nil
 	}
 
-	for {
-		select {
-		case event := <-watcher.Events:
-			fi, _ := os.Lstat(event.Name)
-			if fi.IsDir() {
-				if recurse {
-					watcher.Add(event.Name)
-				}
-				continue
-			}
-			key := strings.TrimPrefix(event.Name, l.Path)
-			l.handleEvent(key, event)
+	events := 0
+	last := time.Now()
+	return func() {
+		events++
+		due := (everyEvents > 0 && events >= everyEvents) || (interval > 0 && time.Since(last) >= interval)
+		if !due {
+			return
 		}
+		if err := storeManifest(c, destination); err != nil {
+			log.Println("error storing manifest:", err)
+		}
+		events = 0
+		last = time.Now()
 	}
 }
 
@@ -156,36 +261,19 @@ func getLocations(c *cli.Context) (*location, *location, error) {
 	results := make([]location, 2)
 
 	for i, param := range c.Args() {
-		loc := location{Path: param}
+		loc := location{}
 		if i == 0 {
 			loc.Type = Source
 		} else if i == 1 {
 			loc.Type = Destination
 		}
-		u, err := url.Parse(param)
+
+		b, err := backend.New(param)
 		if err != nil {
 			return nil, nil, err
 		}
-		if u.Scheme == "" {
-			// Should be a directory?
-			loc.Path = param
-			if loc.Service, err = os.Lstat(param); err != nil {
-				log.Fatal(err)
-			}
-			results[i] = loc
-
-		} else if u.Scheme == "s3" {
-			sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
-			if err != nil {
-				log.Fatal(err)
-			}
-			svc := s3.New(sess)
-			loc.Bucket = u.Host
-			loc.Service = svc
-			results[i] = loc
-		} else {
-			return nil, nil, fmt.Errorf("Unsupported location type \"%s\" for location %s\n", u.Scheme, param)
-		}
+		loc.Backend = b
+		results[i] = loc
 	}
 
 	results[0].Destination = &results[1]
@@ -201,214 +289,226 @@ const (
 )
 
 type location struct {
-	Service     interface{}
-	Bucket      string
-	Path        string          // the base path which we manage objects from
-	Manifest    map[string]file // the key is the object relative to the location's Path
+	Backend     backend.Backend
+	Manifest    map[string]file // the key is the object relative to the location's root
 	Type        LocationType
 	Destination *location
 }
 
-// How do we strip the source's path when writing things to a destination?
-// Takes in an fsnotify event and dispatches the appropriate location action depending on the event type.
-// key is the relative path of the object.
-func (l *location) handleEvent(key string, event fsnotify.Event) {
-	if l.Type == Source {
-		switch event.Op {
-		case fsnotify.Create:
-			f := constructFile(event)
-			l.Manifest[key] = f
-			l.Destination.Put(key, f)
-		case fsnotify.Write:
-			f := constructFile(event)
-			l.Destination.Put(key, f)
-		case fsnotify.Remove:
-			l.Destination.Delete(key)
-			delete(l.Manifest, key)
+// Watch streams change events from the backend to the destination,
+// invoking onEvent (if non-nil) after each one so callers can trigger
+// periodic side effects like manifest snapshots.
+func (l *location) Watch(onEvent func()) error {
+	events, err := l.Backend.Watch()
+	if err != nil {
+		return err
+	}
+
+	for ev := range events {
+		l.handleEvent(ev)
+		if onEvent != nil {
+			onEvent()
 		}
-	} else {
-		log.Fatal("we don't do this")
 	}
+	return nil
 }
 
-// Takes in a file-like object and returns a file.
-func constructFile(input interface{}) file {
-	var f file
-	switch i := input.(type) {
-	case fsnotify.Event:
-		var err error
-		f.Name = filepath.Base(i.Name)
-		f.Path = filepath.Dir(i.Name)
-		f.Object, err = os.Stat(i.Name)
+// handleEvent dispatches a backend.Event from the source's Watch to the
+// destination.
+func (l *location) handleEvent(ev backend.Event) {
+	if l.Type != Source {
+		log.Fatal("we don't do this")
+	}
+	if !activeFilter.PathAllowed(ev.Key) {
+		return
+	}
+
+	switch ev.Op {
+	case backend.Create:
+		f, err := statFile(l.Backend, ev.Key)
 		if err != nil {
 			log.Fatal(err)
 		}
-		return f
-	case *s3.Object:
-		s3Key := *i.Key
-		f.Name = filepath.Base(s3Key)
-		f.Path = filepath.Dir(s3Key)
-		f.Size = int(*i.Size)
-		f.Object = i
-		f.LastModified = *i.LastModified
-	}
-	return f
-}
-
-func (l *location) buildManifest() {
-	l.Manifest = make(map[string]file)
-	switch svc := l.Service.(type) {
-	case *s3.S3:
-		foo := s3.ListObjectsV2Input{}
-		foo.Bucket = aws.String(l.Bucket)
-		foo.Prefix = aws.String(l.Path)
-		f := func(list *s3.ListObjectsV2Output, lastPage bool) bool {
-			for _, o := range list.Contents {
-				f := constructFile(o)
-				key := "/" + strings.TrimPrefix(*o.Key, l.Path)
-				l.Manifest[key] = f
-			}
-
-			// Fetch all pages
-			return true
+		if !activeFilter.Allowed(ev.Key, f.Size) {
+			return
 		}
-		var err error
-		if err = svc.ListObjectsV2Pages(&foo, f); err != nil {
+		l.Manifest[ev.Key] = f
+		l.Destination.Manifest[ev.Key] = f
+		copyObject(l, l.Destination, ev.Key, f)
+	case backend.Write:
+		f, err := statFile(l.Backend, ev.Key)
+		if err != nil {
 			log.Fatal(err)
 		}
-	case os.FileInfo:
-		l.buildDirManifest(l.Path)
-	default:
-		log.Fatal("unknown type")
+		if !activeFilter.Allowed(ev.Key, f.Size) {
+			return
+		}
+		if !fastCompare {
+			if destF, ok := l.Destination.Manifest[ev.Key]; ok {
+				destDigest := destF.Digest(l.Destination.Backend, "")
+				if f.Digest(l.Backend, destDigest) == destDigest {
+					return
+				}
+			}
+		}
+		l.Manifest[ev.Key] = f
+		l.Destination.Manifest[ev.Key] = f
+		copyObject(l, l.Destination, ev.Key, f)
+	case backend.Remove:
+		l.Destination.Backend.Delete(ev.Key)
+		delete(l.Destination.Manifest, ev.Key)
+		delete(l.Manifest, ev.Key)
 	}
 }
 
-func (l *location) buildDirManifest(dir string) {
-	files, err := ioutil.ReadDir(dir)
+// statFile builds a file from a backend.Stat lookup.
+func statFile(b backend.Backend, key string) (file, error) {
+	obj, err := b.Stat(key)
 	if err != nil {
-		log.Fatal(err)
+		return file{}, err
 	}
+	return file{Key: key, Size: obj.Size, LastModified: obj.LastModified, digest: obj.ETag}, nil
+}
 
-	// replace this with a filepath.Walk call
-	for _, fi := range files {
-		if fi.IsDir() {
-			l.buildDirManifest(dir + "/" + fi.Name())
-		} else {
-			var f file
-			key := dir + "/" + fi.Name()
-			key = filepath.Clean(strings.TrimPrefix(key, l.Path))
-			f.Name = fi.Name()
-			f.Size = int(fi.Size())
-			f.Object = fi
-			f.Path = dir
-			f.LastModified = fi.ModTime()
-			l.Manifest[key] = f
+// copyObject streams key from source to destination. When the source is S3
+// and the destination is a local directory, it downloads straight to the
+// destination file with ranged, concurrent GETs rather than buffering
+// through a generic Get/Put round trip.
+func copyObject(source, destination *location, key string, f file) error {
+	if s3Src, ok := source.Backend.(*backends3.Backend); ok {
+		if fileDst, ok := destination.Backend.(*backendfile.Backend); ok {
+			return s3Src.DownloadToFile(key, fileDst.Abs(key))
 		}
 	}
-}
 
-func (l *location) listManifest() {
-	for key, f := range l.Manifest {
-		log.Println(key, f.Name, f.Size, f.LastModified)
+	r, err := source.Backend.Get(key)
+	if err != nil {
+		return err
 	}
+	defer r.Close()
+	return destination.Backend.Put(key, r, f.Size)
 }
 
-// key is the destination relative to the location's Path.
-// f is the thing we're Puting.
-func (l *location) Put(key string, f file) {
-	reader := f.Open()
-	switch svc := l.Service.(type) {
-	case *s3.S3:
-		foo := s3.PutObjectInput{
-			Bucket: aws.String(l.Bucket),
-			Body:   reader,
-			Key:    aws.String(key),
-		}
-		_, err := svc.PutObject(&foo)
-		if err != nil {
-			log.Fatal(err)
-		}
-		l.Manifest[key] = f
-	case os.FileInfo:
-		out, err := os.Create(l.Path + "/" + key)
-		defer out.Close()
-		if err != nil {
-			log.Fatal("error creating:", err)
+func (l *location) buildManifest() {
+	l.Manifest = make(map[string]file)
+	objects, err := l.Backend.List("")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, o := range objects {
+		if isManifestKey(o.Key) {
+			continue
 		}
-		if _, err = io.Copy(out, reader); err != nil {
-			log.Fatal(err)
+		key := strings.TrimPrefix(o.Key, "/")
+		if !activeFilter.Allowed(key, o.Size) {
+			continue
 		}
-		out.Sync()
-	default:
-		log.Fatal("can't handle")
+		l.Manifest[o.Key] = file{Key: o.Key, Size: o.Size, LastModified: o.LastModified, digest: o.ETag}
 	}
 }
 
-func (l *location) Delete(key string) {
-	switch svc := l.Service.(type) {
-	case *s3.S3:
-		foo := s3.DeleteObjectInput{
-			Bucket: aws.String(l.Bucket),
-			Key:    aws.String(key)}
-
-		_, err := svc.DeleteObject(&foo)
-		if err != nil {
-			log.Fatal(err)
-		}
-	case os.FileInfo:
-		if err := os.Remove(l.Path + "/" + key); err != nil {
-			log.Fatal(err)
-		}
-	default:
-		log.Fatal("can't handle")
+func (l *location) listManifest() {
+	for key, f := range l.Manifest {
+		log.Println(key, f.Size, f.LastModified)
 	}
+}
 
-	delete(l.Manifest, key)
+// withinRaceWindow reports whether t is recent enough that a listing which
+// doesn't yet reflect it could simply be lagging, rather than authoritative.
+func withinRaceWindow(t time.Time) bool {
+	return raceWindow > 0 && time.Since(t) < raceWindow
 }
 
 func oneTimeSync(c *cli.Context, source, destination *location) {
+	sem := make(chan struct{}, maxParallelFiles)
+	var wg sync.WaitGroup
+
+	push := func(key string, f file) {
+		destination.Manifest[key] = f
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := copyObject(source, destination, key, f); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	// for each object in the source, push it to the destination
 	for key, f := range source.Manifest {
-		if destF, ok := destination.Manifest[key]; !ok {
+		destF, ok := destination.Manifest[key]
+		if !ok && withinRaceWindow(f.LastModified) {
+			// The destination's listing may have raced ahead of this
+			// object's own recent write; re-check directly rather than
+			// re-pushing (and potentially re-deleting) something that
+			// actually already landed.
+			if obj, err := destination.Backend.Stat(key); err == nil {
+				destF = file{Key: key, Size: obj.Size, LastModified: obj.LastModified, digest: obj.ETag}
+				destination.Manifest[key] = destF
+				ok = true
+			}
+		}
+
+		if !ok {
 			log.Printf("pushing missing %s to destination.", key)
-			destination.Put(key, f)
+			push(key, f)
+		} else if fastCompare {
+			if f.Size != destF.Size || !f.LastModified.Equal(destF.LastModified) {
+				log.Printf("pushing mismatched %s to destination.", key)
+				push(key, f)
+			}
 		} else {
-			if f.Size != destF.Size {
+			destDigest := destF.Digest(destination.Backend, "")
+			if f.Digest(source.Backend, destDigest) != destDigest {
 				log.Printf("pushing mismatched %s to destination.", key)
-				destination.Put(key, f)
+				push(key, f)
 			}
 		}
 	}
+	wg.Wait()
 
 	// for each object in the destination not in the source, delete it from the destination
 	if c.Bool("delete") {
-		for key, _ := range destination.Manifest {
+		for key := range destination.Manifest {
 			if _, ok := source.Manifest[key]; !ok {
 				log.Printf("deleting %s from destination.", key)
-				destination.Delete(key)
+				destination.Backend.Delete(key)
+				delete(destination.Manifest, key)
 			}
 		}
 	}
 }
 
 type file struct {
-	Name         string // The basename of a file
-	Path         string // The absolute directory of a file
+	Key          string // path relative to the location's root
 	LastModified time.Time
-	Size         int
-	Object       interface{}
+	Size         int64
+	digest       string // content digest; lazily populated via Digest
 }
 
-func (f *file) Open() io.ReadSeeker {
-	switch o := f.Object.(type) {
-	case os.FileInfo:
-		_ = o
-		// TODO - This never gets closed.
-		r, err := os.Open(f.Path + "/" + f.Name)
+// Digest returns the file's content digest, Stat-ing the backend on first
+// call if the digest wasn't already known from a List. remoteETag, when
+// non-empty, is the counterpart object's own ETag: for a local file it's
+// used to pick the multipart part size that actually reproduces it,
+// instead of the backend guessing blind.
+func (f *file) Digest(b backend.Backend, remoteETag string) string {
+	if f.digest != "" {
+		return f.digest
+	}
+	if fb, ok := b.(*backendfile.Backend); ok && remoteETag != "" {
+		digest, err := fb.MatchETag(f.Key, remoteETag)
 		if err != nil {
-			log.Fatal("error opening file:", err)
+			log.Fatal("error stat-ing ", f.Key, ": ", err)
 		}
-		return r
+		f.digest = digest
+		return f.digest
 	}
-	return nil
+	obj, err := b.Stat(f.Key)
+	if err != nil {
+		log.Fatal("error stat-ing ", f.Key, ": ", err)
+	}
+	f.digest = obj.ETag
+	return f.digest
 }
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alienth/s3sync/backend"
+	"github.com/urfave/cli"
+)
+
+// manifestPrefix is where manifest snapshots are stored, relative to the
+// location they describe.
+const manifestPrefix = ".syncer/manifests/"
+
+// isManifestKey reports whether key is a manifest snapshot itself, rather
+// than synced content. Both buildManifest (so manifests aren't synced as
+// ordinary objects) and manifestsRestoreCommand's deletion pass (so a
+// restore doesn't wipe out the manifest history it was just restored from)
+// need to exclude these.
+func isManifestKey(key string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(key, "/"), manifestPrefix)
+}
+
+// ManifestEntry records one object as it existed when a Manifest was taken.
+type ManifestEntry struct {
+	Key          string    `json:"key"`
+	ETag         string    `json:"etag"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	VersionID    string    `json:"versionId,omitempty"`
+}
+
+// Manifest is a point-in-time snapshot of a location, optionally signed.
+type Manifest struct {
+	ID        string          `json:"id"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Entries   []ManifestEntry `json:"entries"`
+	PublicKey string          `json:"publicKey,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+}
+
+// newManifestID returns a "<unix-nano timestamp>-<uuid>" identifier, so
+// manifest keys sort chronologically by name.
+func newManifestID() string {
+	return fmt.Sprintf("%d-%s", time.Now().UTC().UnixNano(), newUUID())
+}
+
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Fatal("error generating manifest id: ", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// storeManifest snapshots loc's current contents and writes it to
+// .syncer/manifests/<id>.json within loc itself.
+func storeManifest(c *cli.Context, loc *location) error {
+	entries := make([]ManifestEntry, 0, len(loc.Manifest))
+	for key := range loc.Manifest {
+		obj, err := loc.Backend.Stat(key)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, ManifestEntry{
+			Key:          key,
+			ETag:         obj.ETag,
+			Size:         obj.Size,
+			LastModified: obj.LastModified,
+			VersionID:    obj.VersionID,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	m := Manifest{ID: newManifestID(), CreatedAt: time.Now().UTC(), Entries: entries}
+
+	if keyPath := c.String("sign-key"); keyPath != "" {
+		if err := signManifest(&m, keyPath); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	key := manifestPrefix + m.ID + ".json"
+	log.Printf("storing manifest %s (%d entries)", m.ID, len(entries))
+	return loc.Backend.Put(key, bytes.NewReader(data), int64(len(data)))
+}
+
+// signableBytes returns the canonical bytes a Manifest's signature covers:
+// its entries alone, so re-signing doesn't have to special-case its own
+// PublicKey/Signature fields.
+func signableBytes(entries []ManifestEntry) ([]byte, error) {
+	return json.Marshal(entries)
+}
+
+func signManifest(m *Manifest, keyPath string) error {
+	seed, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("sign-key %s must be a raw %d-byte ed25519 seed", keyPath, ed25519.SeedSize)
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+
+	msg, err := signableBytes(m.Entries)
+	if err != nil {
+		return err
+	}
+	sig := ed25519.Sign(priv, msg)
+
+	m.PublicKey = base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey))
+	m.Signature = base64.StdEncoding.EncodeToString(sig)
+	return nil
+}
+
+// verifyManifest checks m's signature against its embedded public key, and,
+// if trustedKeyPath is non-empty, that the embedded key matches the one at
+// trustedKeyPath. An unsigned manifest only passes when trustedKeyPath is
+// also empty.
+func verifyManifest(m Manifest, trustedKeyPath string) error {
+	if m.Signature == "" {
+		if trustedKeyPath != "" {
+			return fmt.Errorf("manifest %s is unsigned but a trusted key was required", m.ID)
+		}
+		return nil
+	}
+
+	pub, err := base64.StdEncoding.DecodeString(m.PublicKey)
+	if err != nil {
+		return fmt.Errorf("manifest %s: invalid public key: %s", m.ID, err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("manifest %s: invalid signature: %s", m.ID, err)
+	}
+	msg, err := signableBytes(m.Entries)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), msg, sig) {
+		return fmt.Errorf("manifest %s: signature verification failed", m.ID)
+	}
+
+	if trustedKeyPath != "" {
+		trusted, err := ioutil.ReadFile(trustedKeyPath)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(trusted, pub) {
+			return fmt.Errorf("manifest %s: public key does not match %s", m.ID, trustedKeyPath)
+		}
+	}
+	return nil
+}
+
+func manifestsListCommand(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		log.Fatal("must pass the location to list manifests from")
+	}
+	b, err := backend.New(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	objects, err := b.List(manifestPrefix)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if !strings.HasSuffix(o.Key, ".json") {
+			continue
+		}
+		m, err := fetchManifest(b, o.Key)
+		if err != nil {
+			log.Printf("skipping unreadable manifest %s: %s", o.Key, err)
+			continue
+		}
+		signed := "unsigned"
+		if m.Signature != "" {
+			signed = "signed"
+		}
+		fmt.Printf("%s\t%s\t%d entries\t%s\n", m.ID, m.CreatedAt.Format(time.RFC3339), len(m.Entries), signed)
+	}
+	return nil
+}
+
+func manifestsRestoreCommand(c *cli.Context) error {
+	if len(c.Args()) != 3 {
+		log.Fatal("usage: manifests restore <LOCATION> <MANIFEST-ID> <TARGET>")
+	}
+	source, err := backend.New(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	manifestID := c.Args().Get(1)
+	target, err := backend.New(c.Args().Get(2))
+	if err != nil {
+		return err
+	}
+
+	m, err := fetchManifest(source, manifestPrefix+manifestID+".json")
+	if err != nil {
+		return err
+	}
+	if err := verifyManifest(m, c.String("trusted-key")); err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool, len(m.Entries))
+	for _, e := range m.Entries {
+		wanted[e.Key] = true
+		log.Printf("restoring %s", e.Key)
+		r, err := getEntryReader(source, e)
+		if err != nil {
+			return err
+		}
+		err = target.Put(e.Key, r, e.Size)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	existing, err := target.List("")
+	if err != nil {
+		return err
+	}
+	for _, o := range existing {
+		if isManifestKey(o.Key) {
+			continue
+		}
+		if !wanted[o.Key] {
+			log.Printf("deleting %s (not in manifest)", o.Key)
+			if err := target.Delete(o.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func fetchManifest(b backend.Backend, key string) (Manifest, error) {
+	r, err := b.Get(key)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer r.Close()
+
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return Manifest{}, err
+	}
+	return m, nil
+}
+
+// versionedGetter is implemented by backends (currently only S3) that can
+// fetch a specific object version.
+type versionedGetter interface {
+	GetVersion(key, versionID string) (io.ReadCloser, error)
+}
+
+func getEntryReader(b backend.Backend, e ManifestEntry) (io.ReadCloser, error) {
+	if e.VersionID != "" {
+		if vg, ok := b.(versionedGetter); ok {
+			return vg.GetVersion(e.Key, e.VersionID)
+		}
+	}
+	return b.Get(e.Key)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	backendfile "github.com/alienth/s3sync/backend/file"
+	"github.com/urfave/cli"
+)
+
+func TestIsManifestKey(t *testing.T) {
+	cases := []struct {
+		key  string
+		want bool
+	}{
+		{"/" + manifestPrefix + "123.json", true},
+		{manifestPrefix + "123.json", true},
+		{"/a.txt", false},
+		{"a.txt", false},
+	}
+	for _, c := range cases {
+		if got := isManifestKey(c.key); got != c.want {
+			t.Errorf("isManifestKey(%q) = %v, want %v", c.key, got, c.want)
+		}
+	}
+}
+
+// TestManifestsRestoreLeavesManifestHistoryIntact guards against a restore
+// wiping out a target's manifest history: target.List("") also returns
+// prior manifest snapshots, which aren't part of the manifest being
+// restored and must not be swept up by the "delete anything unwanted"
+// pass.
+func TestManifestsRestoreLeavesManifestHistoryIntact(t *testing.T) {
+	source := t.TempDir()
+	target := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(source, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srcBackend := &backendfile.Backend{Root: source}
+	obj, err := srcBackend.Stat("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := Manifest{ID: "test-manifest", Entries: []ManifestEntry{
+		{Key: "/a.txt", ETag: obj.ETag, Size: obj.Size, LastModified: obj.LastModified},
+	}}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srcBackend.Put(manifestPrefix+m.ID+".json", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	// A manifest snapshot already present at the target, from before this
+	// restore, that the restore must leave alone.
+	targetBackend := &backendfile.Backend{Root: target}
+	if err := targetBackend.Put(manifestPrefix+"older-manifest.json", bytes.NewReader([]byte("{}")), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	set := flag.NewFlagSet("restore", 0)
+	set.Parse([]string{source, m.ID, target})
+	ctx := cli.NewContext(nil, set, nil)
+
+	if err := manifestsRestoreCommand(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(target, "a.txt")); err != nil {
+		t.Errorf("restored file missing: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(target, manifestPrefix, "older-manifest.json")); err != nil {
+		t.Errorf("prior manifest was deleted by restore: %s", err)
+	}
+}
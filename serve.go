@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	backendfile "github.com/alienth/s3sync/backend/file"
+	"github.com/urfave/cli"
+)
+
+// serveAccessKey and serveSecretKey authenticate requests to the `serve`
+// subcommand's S3-compatible endpoint. Loaded from SYNCER_ACCESS_KEY_ID /
+// SYNCER_SECRET_ACCESS_KEY so operators don't have to pass secrets on the
+// command line.
+var serveAccessKey string
+var serveSecretKey string
+
+func serveCommand(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		log.Fatal("must pass exactly 1 path to serve")
+	}
+
+	serveAccessKey = os.Getenv("SYNCER_ACCESS_KEY_ID")
+	serveSecretKey = os.Getenv("SYNCER_SECRET_ACCESS_KEY")
+	if serveAccessKey == "" || serveSecretKey == "" {
+		log.Fatal("SYNCER_ACCESS_KEY_ID and SYNCER_SECRET_ACCESS_KEY must be set")
+	}
+
+	srv := &s3Server{backend: &backendfile.Backend{Root: c.Args().First()}}
+
+	listen := c.String("listen")
+	log.Printf("serving %s as an S3 endpoint on %s", c.Args().First(), listen)
+	return http.ListenAndServe(listen, srv)
+}
+
+type s3Server struct {
+	backend *backendfile.Backend
+}
+
+func (s *s3Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := verifySigV4(req, serveAccessKey, serveSecretKey); err != nil {
+		http.Error(w, "access denied: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	key := strings.TrimPrefix(req.URL.Path, "/")
+
+	switch req.Method {
+	case http.MethodGet:
+		if _, ok := req.URL.Query()["versioning"]; ok {
+			s.getBucketVersioning(w)
+			return
+		}
+		if key == "" {
+			s.listObjectsV2(w, req)
+			return
+		}
+		s.getObject(w, req, key)
+	case http.MethodHead:
+		s.headObject(w, req, key)
+	case http.MethodPut:
+		s.putObject(w, req, key)
+	case http.MethodDelete:
+		s.deleteObject(w, req, key)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *s3Server) getObject(w http.ResponseWriter, req *http.Request, key string) {
+	if req.URL.Query().Get("versioning") != "" {
+		s.getBucketVersioning(w)
+		return
+	}
+
+	obj, err := s.backend.Stat(key)
+	if os.IsNotExist(err) {
+		http.Error(w, "NoSuchKey", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(s.backend.Abs(key))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("ETag", `"`+obj.ETag+`"`)
+	http.ServeContent(w, req, key, obj.LastModified, f)
+}
+
+func (s *s3Server) headObject(w http.ResponseWriter, req *http.Request, key string) {
+	obj, err := s.backend.Stat(key)
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", `"`+obj.ETag+`"`)
+	w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	w.Header().Set("Last-Modified", obj.LastModified.UTC().Format(http.TimeFormat))
+}
+
+func (s *s3Server) putObject(w http.ResponseWriter, req *http.Request, key string) {
+	if err := s.backend.Put(key, req.Body, req.ContentLength); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *s3Server) deleteObject(w http.ResponseWriter, req *http.Request, key string) {
+	if err := s.backend.Delete(key); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *s3Server) getBucketVersioning(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><VersioningConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></VersioningConfiguration>`))
+}
+
+const maxListKeys = 1000
+
+type listBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string   `xml:"Name"`
+	Prefix                string   `xml:"Prefix"`
+	Delimiter             string   `xml:"Delimiter,omitempty"`
+	KeyCount              int      `xml:"KeyCount"`
+	MaxKeys               int      `xml:"MaxKeys"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	ContinuationToken     string   `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string   `xml:"NextContinuationToken,omitempty"`
+	Contents              []listEntry `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type listEntry struct {
+	Key          string `xml:"Key"`
+	Size         int64  `xml:"Size"`
+	ETag         string `xml:"ETag"`
+	LastModified string `xml:"LastModified"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+func (s *s3Server) listObjectsV2(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	continuationToken := q.Get("continuation-token")
+
+	maxKeys := maxListKeys
+	if mk, err := strconv.Atoi(q.Get("max-keys")); err == nil && mk > 0 && mk < maxListKeys {
+		maxKeys = mk
+	}
+
+	var startAfter string
+	if continuationToken != "" {
+		decoded, err := base64.StdEncoding.DecodeString(continuationToken)
+		if err != nil {
+			http.Error(w, "invalid continuation-token", http.StatusBadRequest)
+			return
+		}
+		startAfter = string(decoded)
+	}
+
+	objects, err := s.backend.List(prefix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	result := listBucketResult{
+		Name:              "local",
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		ContinuationToken: continuationToken,
+	}
+
+	seenPrefixes := make(map[string]bool)
+	var lastKey string
+	for _, o := range objects {
+		if o.Key <= startAfter {
+			continue
+		}
+		if result.KeyCount >= maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(lastKey))
+			break
+		}
+
+		if delimiter != "" {
+			rest := strings.TrimPrefix(o.Key, prefix)
+			if idx := strings.Index(rest, delimiter); idx != -1 {
+				cp := prefix + rest[:idx+len(delimiter)]
+				if !seenPrefixes[cp] {
+					seenPrefixes[cp] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: cp})
+				}
+				lastKey = o.Key
+				continue
+			}
+		}
+
+		etag := o.ETag
+		if etag == "" {
+			if stat, err := s.backend.Stat(o.Key); err == nil {
+				etag = stat.ETag
+			}
+		}
+		result.Contents = append(result.Contents, listEntry{
+			Key:          o.Key,
+			Size:         o.Size,
+			ETag:         `"` + etag + `"`,
+			LastModified: o.LastModified.UTC().Format("2006-01-02T15:04:05.000Z"),
+		})
+		result.KeyCount++
+		lastKey = o.Key
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(result)
+}